@@ -0,0 +1,135 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alerting
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Alert is a single Alertmanager v2 alert, POSTed as a one-element array to
+// /api/v2/alerts.
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	// EndsAt is a pointer so a firing (unresolved) alert omits "endsAt"
+	// entirely; a zero-value time.Time would marshal to "0001-01-01T00:00:00Z",
+	// which Alertmanager treats as already resolved.
+	EndsAt *time.Time `json:"endsAt,omitempty"`
+}
+
+// AlertmanagerClient sends alerts to Alertmanager.
+type AlertmanagerClient interface {
+	Send(alert Alert) error
+}
+
+// ClientConfig configures how alerts are POSTed to Alertmanager.
+type ClientConfig struct {
+	URL      string
+	Username string
+	Password string
+
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCAFile   string
+
+	Timeout time.Duration
+}
+
+type httpClient struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+}
+
+// NewClient builds an AlertmanagerClient that POSTs to
+// config.URL + "/api/v2/alerts", optionally using basic auth and/or client
+// TLS as configured.
+func NewClient(config ClientConfig) (AlertmanagerClient, error) {
+	transport := &http.Transport{}
+
+	if config.TLSCAFile != "" || config.TLSCertFile != "" {
+		tlsConfig := &tls.Config{}
+
+		if config.TLSCAFile != "" {
+			caCert, err := ioutil.ReadFile(config.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read alertmanager CA file: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caCert) {
+				return nil, fmt.Errorf("failed to parse alertmanager CA file %s", config.TLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		if config.TLSCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load alertmanager client certificate: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &httpClient{
+		url:      config.URL,
+		username: config.Username,
+		password: config.Password,
+		client:   &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+func (c *httpClient) Send(alert Alert) error {
+	body, err := json.Marshal([]Alert{alert})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url+"/api/v2/alerts", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alertmanager returned status %d", resp.StatusCode)
+	}
+	return nil
+}
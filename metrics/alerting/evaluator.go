@@ -0,0 +1,304 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alerting
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/heapster/metrics/core"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	alertsFiring = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heapster_alerts_firing",
+		Help: "Number of alert series currently firing.",
+	})
+	alertsPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heapster_alerts_pending",
+		Help: "Number of alert series waiting for their 'for' duration to elapse before firing.",
+	})
+	alertSendFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "heapster_alert_send_failures_total",
+		Help: "Number of failed attempts to POST alerts to Alertmanager.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(alertsFiring)
+	prometheus.MustRegister(alertsPending)
+	prometheus.MustRegister(alertSendFailures)
+}
+
+// fingerprint identifies a single series matched by a rule, so pending/
+// firing state survives across scrape cycles even though MetricSets are
+// rebuilt every cycle.
+type fingerprint string
+
+func fingerprintOf(ruleName string, labels map[string]string) fingerprint {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s", ruleName)
+	for _, k := range keys {
+		fmt.Fprintf(h, ",%s=%s", k, labels[k])
+	}
+	return fingerprint(fmt.Sprintf("%x", h.Sum(nil)))
+}
+
+// seriesState tracks a single matched series' progress toward, or hold on,
+// firing.
+type seriesState struct {
+	labels      map[string]string
+	value       float64
+	pendingFrom time.Time
+	firingSince time.Time
+	firing      bool
+	lastSent    time.Time
+}
+
+// ruleState is the per-rule bookkeeping the Evaluator keeps between scrape
+// cycles.
+type ruleState struct {
+	rule   Rule
+	forDur time.Duration
+	series map[fingerprint]*seriesState
+}
+
+// Evaluator evaluates a fixed set of Rules against every core.DataBatch
+// handed to it and dispatches alert state transitions to an
+// AlertmanagerClient.
+type Evaluator struct {
+	client         AlertmanagerClient
+	resendInterval time.Duration
+
+	mu    sync.Mutex
+	rules []*ruleState
+}
+
+// NewEvaluator builds an Evaluator for rules, sending alerts through client
+// and re-sending still-firing alerts every resendInterval.
+func NewEvaluator(rules []Rule, client AlertmanagerClient, resendInterval time.Duration) (*Evaluator, error) {
+	e := &Evaluator{
+		client:         client,
+		resendInterval: resendInterval,
+	}
+
+	for _, r := range rules {
+		forDur, err := parseFor(r.For)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		e.rules = append(e.rules, &ruleState{
+			rule:   r,
+			forDur: forDur,
+			series: make(map[fingerprint]*seriesState),
+		})
+	}
+
+	return e, nil
+}
+
+func parseFor(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Evaluate runs every configured rule against batch, updating pending/firing
+// state and sending any resulting alert transitions to Alertmanager. It
+// never mutates or drops data from batch.
+func (e *Evaluator) Evaluate(batch *core.DataBatch) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := batch.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var pendingCount, firingCount int
+	for _, rs := range e.rules {
+		matched := matchSeries(batch, rs.rule)
+		e.evaluateRule(rs, matched, now)
+
+		for _, s := range rs.series {
+			if s.firing {
+				firingCount++
+			} else if !s.pendingFrom.IsZero() {
+				pendingCount++
+			}
+		}
+	}
+
+	alertsFiring.Set(float64(firingCount))
+	alertsPending.Set(float64(pendingCount))
+}
+
+// matchedSeries is one MetricSet's aggregated value under a rule.
+type matchedSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+// matchSeries finds every MetricSet in batch whose labels satisfy
+// rule.LabelSelector and returns their value for rule.Metric, aggregated
+// across sets per rule.Aggregation when it is not "none".
+func matchSeries(batch *core.DataBatch, rule Rule) []matchedSeries {
+	var matched []matchedSeries
+	for _, set := range batch.MetricSets {
+		if !labelsMatch(set.Labels, rule.LabelSelector) {
+			continue
+		}
+		mv, ok := set.MetricValues[rule.Metric]
+		if !ok {
+			continue
+		}
+		matched = append(matched, matchedSeries{labels: set.Labels, value: metricValueToFloat(mv)})
+	}
+
+	if rule.Aggregation == "" || rule.Aggregation == AggregationNone || len(matched) == 0 {
+		return matched
+	}
+
+	var agg float64
+	switch rule.Aggregation {
+	case AggregationSum, AggregationAvg:
+		for _, m := range matched {
+			agg += m.value
+		}
+		if rule.Aggregation == AggregationAvg {
+			agg /= float64(len(matched))
+		}
+	case AggregationMax:
+		agg = matched[0].value
+		for _, m := range matched[1:] {
+			if m.value > agg {
+				agg = m.value
+			}
+		}
+	}
+
+	return []matchedSeries{{labels: map[string]string{"aggregation": string(rule.Aggregation)}, value: agg}}
+}
+
+func labelsMatch(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func metricValueToFloat(mv core.MetricValue) float64 {
+	if mv.ValueType == core.ValueFloat {
+		return mv.FloatValue
+	}
+	return float64(mv.IntValue)
+}
+
+func (e *Evaluator) evaluateRule(rs *ruleState, matched []matchedSeries, now time.Time) {
+	seen := make(map[fingerprint]bool, len(matched))
+
+	for _, m := range matched {
+		fp := fingerprintOf(rs.rule.Name, m.labels)
+		seen[fp] = true
+
+		s, ok := rs.series[fp]
+		if !ok {
+			s = &seriesState{labels: m.labels}
+			rs.series[fp] = s
+		}
+		s.value = m.value
+
+		holds := rs.rule.Condition.evaluate(m.value, rs.rule.Threshold)
+		switch {
+		case holds && s.firing:
+			// Still firing: resend on the configured interval.
+			if now.Sub(s.lastSent) >= e.resendInterval {
+				e.send(rs.rule, s, now, false)
+			}
+		case holds && !s.firing:
+			if s.pendingFrom.IsZero() {
+				s.pendingFrom = now
+			}
+			if now.Sub(s.pendingFrom) >= rs.forDur {
+				s.firing = true
+				s.firingSince = now
+				e.send(rs.rule, s, now, false)
+			}
+		case !holds:
+			s.pendingFrom = time.Time{}
+			if s.firing {
+				s.firing = false
+				e.send(rs.rule, s, now, true)
+			}
+		}
+	}
+
+	for fp, s := range rs.series {
+		if seen[fp] {
+			continue
+		}
+		// The series disappeared entirely; resolve it if it was firing and
+		// forget about it.
+		if s.firing {
+			e.send(rs.rule, s, now, true)
+		}
+		delete(rs.series, fp)
+	}
+}
+
+func (e *Evaluator) send(rule Rule, s *seriesState, now time.Time, resolved bool) {
+	alert := Alert{
+		Labels:      mergeLabels(rule.Name, rule.Severity, s.labels),
+		Annotations: rule.Annotations,
+		StartsAt:    s.firingSince,
+	}
+	if resolved {
+		alert.EndsAt = &now
+	}
+
+	if err := e.client.Send(alert); err != nil {
+		alertSendFailures.Inc()
+		glog.Errorf("failed to send alert for rule %s: %v", rule.Name, err)
+		return
+	}
+	s.lastSent = now
+}
+
+func mergeLabels(ruleName, severity string, seriesLabels map[string]string) map[string]string {
+	labels := make(map[string]string, len(seriesLabels)+2)
+	for k, v := range seriesLabels {
+		labels[k] = v
+	}
+	labels["alertname"] = ruleName
+	if severity != "" {
+		labels["severity"] = severity
+	}
+	return labels
+}
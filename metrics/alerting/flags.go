@@ -0,0 +1,75 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alerting
+
+import (
+	"flag"
+	"time"
+)
+
+var (
+	alertRulesFile      = flag.String("alert-rules-file", "", "YAML file of alerting rules to evaluate against each scrape. Alerting is disabled when empty.")
+	alertmanagerURL     = flag.String("alertmanager-url", "", "Base URL of the Alertmanager instance to send alerts to, e.g. http://alertmanager:9093.")
+	alertmanagerUser    = flag.String("alertmanager-username", "", "Username for basic auth against Alertmanager.")
+	alertmanagerPass    = flag.String("alertmanager-password", "", "Password for basic auth against Alertmanager.")
+	alertmanagerCAFile  = flag.String("alertmanager-tls-ca-file", "", "CA certificate to verify the Alertmanager server certificate.")
+	alertmanagerCert    = flag.String("alertmanager-tls-cert-file", "", "Client certificate for TLS to Alertmanager.")
+	alertmanagerKey     = flag.String("alertmanager-tls-key-file", "", "Client key for TLS to Alertmanager.")
+	alertResendInterval = flag.Duration("alert-resend-interval", 4*time.Minute, "How often a still-firing alert is re-sent to Alertmanager.")
+)
+
+// Config groups the flag-configurable knobs for the alerting stage.
+type Config struct {
+	RulesFile      string
+	ResendInterval time.Duration
+	Client         ClientConfig
+}
+
+// ConfigFromFlags builds a Config from the --alert-* flags. RulesFile is
+// empty (and alerting disabled) unless --alert-rules-file was passed.
+func ConfigFromFlags() Config {
+	return Config{
+		RulesFile:      *alertRulesFile,
+		ResendInterval: *alertResendInterval,
+		Client: ClientConfig{
+			URL:         *alertmanagerURL,
+			Username:    *alertmanagerUser,
+			Password:    *alertmanagerPass,
+			TLSCAFile:   *alertmanagerCAFile,
+			TLSCertFile: *alertmanagerCert,
+			TLSKeyFile:  *alertmanagerKey,
+		},
+	}
+}
+
+// NewEvaluatorFromConfig loads rules and builds a client from config,
+// returning nil, nil when alerting is disabled (config.RulesFile == "").
+func NewEvaluatorFromConfig(config Config) (*Evaluator, error) {
+	if config.RulesFile == "" {
+		return nil, nil
+	}
+
+	rules, err := LoadRules(config.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(config.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEvaluator(rules, client, config.ResendInterval)
+}
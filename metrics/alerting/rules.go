@@ -0,0 +1,124 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alerting evaluates user-configured threshold rules against each
+// scraped core.DataBatch and dispatches firing/resolved alerts to
+// Alertmanager. It is wired into realManager.housekeep as a stage that runs
+// after processors and before sink export.
+package alerting
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Condition is a comparison operator applied to an aggregated metric value.
+type Condition string
+
+const (
+	ConditionGreaterThan    Condition = ">"
+	ConditionLessThan       Condition = "<"
+	ConditionGreaterOrEqual Condition = ">="
+	ConditionLessOrEqual    Condition = "<="
+	ConditionEqual          Condition = "=="
+)
+
+// Aggregation combines the values of every MetricSet matched by a Rule's
+// LabelSelector into a single number before Condition is applied.
+type Aggregation string
+
+const (
+	AggregationNone Aggregation = "none"
+	AggregationSum  Aggregation = "sum"
+	AggregationAvg  Aggregation = "avg"
+	AggregationMax  Aggregation = "max"
+)
+
+// Rule is a single alerting rule loaded from --alert-rules-file.
+type Rule struct {
+	Name          string            `yaml:"name"`
+	Metric        string            `yaml:"metric"`
+	LabelSelector map[string]string `yaml:"labelSelector"`
+	Aggregation   Aggregation       `yaml:"aggregation"`
+	Condition     Condition         `yaml:"condition"`
+	Threshold     float64           `yaml:"threshold"`
+	For           string            `yaml:"for"`
+	Severity      string            `yaml:"severity"`
+	Annotations   map[string]string `yaml:"annotations"`
+}
+
+// RuleFile is the top-level structure of --alert-rules-file.
+type RuleFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// LoadRules reads and parses a rule file in the format documented on Rule.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert rules file %s: %v", path, err)
+	}
+
+	var file RuleFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse alert rules file %s: %v", path, err)
+	}
+
+	for i, r := range file.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("invalid rule %d (%s): %v", i, r.Name, err)
+		}
+	}
+
+	return file.Rules, nil
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("metric is required")
+	}
+	switch r.Condition {
+	case ConditionGreaterThan, ConditionLessThan, ConditionGreaterOrEqual, ConditionLessOrEqual, ConditionEqual:
+	default:
+		return fmt.Errorf("unsupported condition %q", r.Condition)
+	}
+	switch r.Aggregation {
+	case "", AggregationNone, AggregationSum, AggregationAvg, AggregationMax:
+	default:
+		return fmt.Errorf("unsupported aggregation %q", r.Aggregation)
+	}
+	return nil
+}
+
+func (c Condition) evaluate(value, threshold float64) bool {
+	switch c {
+	case ConditionGreaterThan:
+		return value > threshold
+	case ConditionLessThan:
+		return value < threshold
+	case ConditionGreaterOrEqual:
+		return value >= threshold
+	case ConditionLessOrEqual:
+		return value <= threshold
+	case ConditionEqual:
+		return value == threshold
+	default:
+		return false
+	}
+}
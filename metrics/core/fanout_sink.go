@@ -0,0 +1,342 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultFanoutSinkQueueLength bounds how many batches are buffered per
+	// child sink before the oldest is dropped.
+	DefaultFanoutSinkQueueLength = 16
+	// DefaultFanoutSinkExportTimeout bounds how long a single child sink is
+	// given to export one batch before it is treated as failed.
+	DefaultFanoutSinkExportTimeout = 20 * time.Second
+	// DefaultFanoutSinkMaxRetries is how many times a failed export is
+	// retried before the batch is dropped for that child sink.
+	DefaultFanoutSinkMaxRetries = 2
+	// DefaultFanoutSinkStopGracePeriod bounds how long Stop waits for a
+	// child sink's queue to drain before stopping it anyway.
+	DefaultFanoutSinkStopGracePeriod = 30 * time.Second
+)
+
+var (
+	sinkExportDuration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name: "heapster_sink_export_duration_seconds",
+		Help: "Time spent by FanoutSink exporting a batch to a single child sink.",
+	}, []string{"sink"})
+	sinkExportErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "heapster_sink_export_errors_total",
+		Help: "Number of batches a single child sink failed to export after all retries.",
+	}, []string{"sink"})
+	sinkQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "heapster_sink_queue_length",
+		Help: "Number of batches currently queued for a single child sink.",
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(sinkExportDuration)
+	prometheus.MustRegister(sinkExportErrors)
+	prometheus.MustRegister(sinkQueueLength)
+}
+
+// FanoutSinkConfig controls the per-child-sink queueing, timeout and retry
+// policy of a FanoutSink.
+type FanoutSinkConfig struct {
+	QueueLength   int
+	ExportTimeout time.Duration
+	MaxRetries    int
+	StopGrace     time.Duration
+}
+
+// DefaultFanoutSinkConfig returns a FanoutSinkConfig populated with the
+// package defaults.
+func DefaultFanoutSinkConfig() FanoutSinkConfig {
+	return FanoutSinkConfig{
+		QueueLength:   DefaultFanoutSinkQueueLength,
+		ExportTimeout: DefaultFanoutSinkExportTimeout,
+		MaxRetries:    DefaultFanoutSinkMaxRetries,
+		StopGrace:     DefaultFanoutSinkStopGracePeriod,
+	}
+}
+
+// SinkHealth is the point-in-time health of a single child sink, as
+// reported by the /sinks endpoint.
+type SinkHealth struct {
+	Name         string    `json:"name"`
+	QueueLength  int       `json:"queueLength"`
+	LastSuccess  time.Time `json:"lastSuccess"`
+	ErrorRate    float64   `json:"errorRate"`
+	exportCount  int64
+	exportErrors int64
+}
+
+// FanoutSink dispatches every ExportData call to N underlying DataSinks in
+// parallel, each with its own bounded queue, timeout and retry policy, so
+// that one slow or failing sink can neither delay nor abort exports to the
+// others. It implements DataSink itself, so it is a drop-in replacement for
+// a plain sink anywhere a Manager expects one.
+type FanoutSink struct {
+	config FanoutSinkConfig
+	sinks  []*fanoutChild
+
+	stopChan chan struct{}
+}
+
+// NewFanoutSink builds a FanoutSink over sinks, using config for every
+// child's queue/timeout/retry policy.
+func NewFanoutSink(sinks []DataSink, config FanoutSinkConfig) *FanoutSink {
+	if config.QueueLength <= 0 {
+		config.QueueLength = DefaultFanoutSinkQueueLength
+	}
+	if config.ExportTimeout <= 0 {
+		config.ExportTimeout = DefaultFanoutSinkExportTimeout
+	}
+	if config.StopGrace <= 0 {
+		config.StopGrace = DefaultFanoutSinkStopGracePeriod
+	}
+
+	fs := &FanoutSink{
+		config:   config,
+		stopChan: make(chan struct{}),
+	}
+
+	for _, s := range sinks {
+		child := &fanoutChild{
+			sink:     s,
+			config:   config,
+			queue:    make(chan *DataBatch, config.QueueLength),
+			stopChan: fs.stopChan,
+			doneChan: make(chan struct{}),
+			health:   &SinkHealth{Name: s.Name()},
+		}
+		fs.sinks = append(fs.sinks, child)
+
+		go child.run()
+	}
+
+	return fs
+}
+
+// Name identifies the wrapper for diagnostic purposes.
+func (fs *FanoutSink) Name() string {
+	return "fanout_sink"
+}
+
+// ExportData enqueues data onto every child sink's queue and returns
+// immediately; it never blocks on a child sink's ExportData call.
+func (fs *FanoutSink) ExportData(data *DataBatch) {
+	for _, child := range fs.sinks {
+		child.enqueue(data)
+	}
+}
+
+// Stop drains and stops every child sink independently and in parallel,
+// waiting up to config.StopGrace for each sink's queue to drain before
+// stopping it anyway; a slow child cannot delay any other child's shutdown. The per-child queues are never
+// closed (an in-flight ExportData could still be sending on one), so each
+// child's run loop instead exits on fs.stopChan once it has drained whatever
+// was already queued.
+func (fs *FanoutSink) Stop() {
+	close(fs.stopChan)
+
+	var wg sync.WaitGroup
+	for _, child := range fs.sinks {
+		wg.Add(1)
+		go func(c *fanoutChild) {
+			defer wg.Done()
+			select {
+			case <-c.doneChan:
+			case <-time.After(fs.config.StopGrace):
+				glog.Warningf("fanout sink: stop grace period elapsed before %s drained", c.sink.Name())
+			}
+			c.sink.Stop()
+		}(child)
+	}
+	wg.Wait()
+}
+
+// ServeHTTP implements the /sinks endpoint: a JSON array of each child
+// sink's last success time, queue depth, and error rate.
+func (fs *FanoutSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := make([]SinkHealth, 0, len(fs.sinks))
+	for _, child := range fs.sinks {
+		report = append(report, child.snapshot())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// fanoutChild owns one child sink's queue, sender goroutine and health
+// bookkeeping.
+type fanoutChild struct {
+	sink   DataSink
+	config FanoutSinkConfig
+
+	queue    chan *DataBatch
+	stopChan <-chan struct{}
+	doneChan chan struct{}
+
+	mu     sync.Mutex
+	health *SinkHealth
+}
+
+func (c *fanoutChild) enqueue(data *DataBatch) {
+	select {
+	case c.queue <- data:
+	default:
+		// Queue full: drop the oldest to make room, so a stuck sink falls
+		// behind rather than blocking the fanout.
+		select {
+		case <-c.queue:
+		default:
+		}
+		select {
+		case c.queue <- data:
+		default:
+		}
+	}
+	sinkQueueLength.WithLabelValues(c.sink.Name()).Set(float64(len(c.queue)))
+}
+
+func (c *fanoutChild) run() {
+	defer close(c.doneChan)
+	for {
+		select {
+		case data := <-c.queue:
+			c.exportWithRetry(data)
+			sinkQueueLength.WithLabelValues(c.sink.Name()).Set(float64(len(c.queue)))
+		case <-c.stopChan:
+			// Drain whatever was already queued before exiting; the queue
+			// itself is never closed, since ExportData may still be
+			// enqueueing onto it concurrently with shutdown.
+			for {
+				select {
+				case data := <-c.queue:
+					c.exportWithRetry(data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *fanoutChild) exportWithRetry(data *DataBatch) {
+	maxRetries := c.config.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		start := time.Now()
+		err := c.exportOnce(data)
+		sinkExportDuration.WithLabelValues(c.sink.Name()).Observe(time.Now().Sub(start).Seconds())
+
+		if err == nil {
+			c.mu.Lock()
+			c.health.LastSuccess = time.Now()
+			c.health.exportCount++
+			c.health.errorRate()
+			c.mu.Unlock()
+			return
+		}
+		lastErr = err
+	}
+
+	sinkExportErrors.WithLabelValues(c.sink.Name()).Inc()
+	c.mu.Lock()
+	c.health.exportCount++
+	c.health.exportErrors++
+	c.health.errorRate()
+	c.mu.Unlock()
+	glog.Errorf("fanout sink: giving up exporting to %s after %d attempts: %v", c.sink.Name(), maxRetries+1, lastErr)
+}
+
+// exportOnce calls the child sink with a timeout, recovering a panic into an
+// error so one misbehaving sink can't take down its goroutine. DataSink has
+// no way to cancel an in-flight ExportData, so on timeout this still waits
+// for the call to actually return before reporting the error: heapster sinks
+// assume serial ExportData calls, and abandoning the goroutine would let the
+// next queued batch start a second, concurrent ExportData against the same
+// child sink.
+func (c *fanoutChild) exportOnce(data *DataBatch) (err error) {
+	done := make(chan struct{})
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &fanoutPanicError{r}
+			}
+			close(done)
+		}()
+		c.sink.ExportData(data)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-time.After(c.config.ExportTimeout):
+		timeoutErr := &fanoutTimeoutError{sink: c.sink.Name(), timeout: c.config.ExportTimeout}
+		<-done
+		return timeoutErr
+	}
+}
+
+func (c *fanoutChild) snapshot() SinkHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := *c.health
+	h.QueueLength = len(c.queue)
+	return h
+}
+
+// errorRate recomputes ErrorRate from the running export/error counters.
+// Callers must hold c.mu (via the enclosing fanoutChild).
+func (h *SinkHealth) errorRate() {
+	if h.exportCount == 0 {
+		h.ErrorRate = 0
+		return
+	}
+	h.ErrorRate = float64(h.exportErrors) / float64(h.exportCount)
+}
+
+type fanoutTimeoutError struct {
+	sink    string
+	timeout time.Duration
+}
+
+func (e *fanoutTimeoutError) Error() string {
+	return "export to " + e.sink + " timed out after " + e.timeout.String()
+}
+
+type fanoutPanicError struct {
+	v interface{}
+}
+
+func (e *fanoutPanicError) Error() string {
+	return "panic in sink.ExportData"
+}
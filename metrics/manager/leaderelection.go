@@ -0,0 +1,233 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager
+
+import (
+	"flag"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElectionConfig groups the flag-configurable knobs for running
+// multiple heapster replicas behind a Kubernetes Lease.
+type LeaderElectionConfig struct {
+	LeaderElect bool
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	ResourceNamespace string
+	ResourceName      string
+}
+
+// DefaultLeaderElectionConfig returns the flag defaults used when
+// --leader-elect is set without overriding the individual timings.
+func DefaultLeaderElectionConfig() LeaderElectionConfig {
+	return LeaderElectionConfig{
+		LeaseDuration:     15 * time.Second,
+		RenewDeadline:     10 * time.Second,
+		RetryPeriod:       2 * time.Second,
+		ResourceNamespace: "kube-system",
+		ResourceName:      "heapster",
+	}
+}
+
+var (
+	leaderElect                  = flag.Bool("leader-elect", false, "Run multiple heapster replicas behind a Kubernetes Lease; only the lease holder scrapes and exports.")
+	leaderElectLeaseDuration     = flag.Duration("leader-elect-lease-duration", DefaultLeaderElectionConfig().LeaseDuration, "Duration non-leader candidates wait before attempting to acquire the leader lease.")
+	leaderElectRenewDeadline     = flag.Duration("leader-elect-renew-deadline", DefaultLeaderElectionConfig().RenewDeadline, "Duration the leader retries refreshing the lease before giving it up.")
+	leaderElectRetryPeriod       = flag.Duration("leader-elect-retry-period", DefaultLeaderElectionConfig().RetryPeriod, "Duration candidates wait between actions in the leader election loop.")
+	leaderElectResourceNamespace = flag.String("leader-elect-resource-namespace", DefaultLeaderElectionConfig().ResourceNamespace, "Namespace of the Lease object used for leader election.")
+	leaderElectResourceName      = flag.String("leader-elect-resource-name", DefaultLeaderElectionConfig().ResourceName, "Name of the Lease object used for leader election.")
+)
+
+// LeaderElectionConfigFromFlags builds a LeaderElectionConfig from the
+// --leader-elect* flags. LeaderElect is false unless --leader-elect was
+// passed, in which case the other fields fall back to their defaults.
+func LeaderElectionConfigFromFlags() LeaderElectionConfig {
+	return LeaderElectionConfig{
+		LeaderElect:       *leaderElect,
+		LeaseDuration:     *leaderElectLeaseDuration,
+		RenewDeadline:     *leaderElectRenewDeadline,
+		RetryPeriod:       *leaderElectRetryPeriod,
+		ResourceNamespace: *leaderElectResourceNamespace,
+		ResourceName:      *leaderElectResourceName,
+	}
+}
+
+var (
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heapster_is_leader",
+		Help: "Whether this heapster instance currently holds the leader lease (1) or not (0).",
+	})
+	leaderTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "heapster_leader_transitions_total",
+		Help: "Number of leader election transitions, by transition type.",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(isLeader)
+	prometheus.MustRegister(leaderTransitionsTotal)
+}
+
+// LeaderElectedManager wraps a realManager so that only the elected leader
+// among a set of heapster replicas runs Housekeep. Followers stay alive to
+// keep serving /metrics and /healthz, but never scrape or export.
+type LeaderElectedManager struct {
+	delegate *realManager
+	config   LeaderElectionConfig
+	elector  *leaderelection.LeaderElector
+
+	mu            sync.Mutex
+	running       bool
+	housekeepStop chan struct{}
+
+	stopChan chan struct{}
+}
+
+// NewLeaderElectedManager wraps manager with leader election backed by a
+// Lease named config.ResourceName in config.ResourceNamespace. identity
+// should uniquely identify this process, e.g. its pod name; when empty, the
+// hostname is used.
+func NewLeaderElectedManager(manager *realManager, client kubernetes.Interface, config LeaderElectionConfig, identity string) (*LeaderElectedManager, error) {
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		identity = hostname
+	}
+
+	lem := &LeaderElectedManager{
+		delegate: manager,
+		config:   config,
+		stopChan: make(chan struct{}),
+	}
+
+	lock, err := resourcelock.New(
+		resourcelock.LeasesResourceLock,
+		config.ResourceNamespace,
+		config.ResourceName,
+		client.CoreV1(),
+		client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: config.LeaseDuration,
+		RenewDeadline: config.RenewDeadline,
+		RetryPeriod:   config.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: lem.onStartedLeading,
+			OnStoppedLeading: lem.onStoppedLeading,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	lem.elector = elector
+
+	return lem, nil
+}
+
+// Start begins running the leader election loop in the background. Only the
+// current leader will have its housekeeping loop started; the loop is
+// stopped and restarted as the lease changes hands.
+func (lem *LeaderElectedManager) Start() {
+	go func() {
+		for {
+			select {
+			case <-lem.stopChan:
+				return
+			default:
+				lem.elector.Run()
+			}
+		}
+	}()
+}
+
+// Stop stops the housekeeping loop, waits for any in-flight scrape to finish
+// via the delegate's own housekeepSemaphoreChan, and only then tears down the
+// delegate's sink. It does not release the lease: closing stopChan only keeps
+// the election loop from being started again once the current Run returns.
+func (lem *LeaderElectedManager) Stop() {
+	close(lem.stopChan)
+	lem.stopHousekeeping()
+	lem.delegate.drainInFlight()
+	lem.delegate.sink.Stop()
+}
+
+// stopHousekeeping pauses the scrape loop by closing its term-scoped stop
+// channel. It deliberately does not touch the delegate's sink: leadership
+// handoff (lose lease, then regain it later) is the normal case for HA, and
+// the sink (which may itself be a queue.Manager or FanoutSink with its own
+// shards/workers) must survive across handoffs to be usable again on
+// reacquisition.
+func (lem *LeaderElectedManager) stopHousekeeping() {
+	lem.mu.Lock()
+	defer lem.mu.Unlock()
+	if !lem.running {
+		return
+	}
+	lem.running = false
+	close(lem.housekeepStop)
+	lem.housekeepStop = nil
+}
+
+func (lem *LeaderElectedManager) onStartedLeading(stop <-chan struct{}) {
+	glog.Infof("acquired leader lease %s/%s, starting housekeeping", lem.config.ResourceNamespace, lem.config.ResourceName)
+	isLeader.Set(1)
+	leaderTransitionsTotal.WithLabelValues("acquired").Inc()
+
+	lem.mu.Lock()
+	lem.running = true
+	lem.housekeepStop = make(chan struct{})
+	housekeepStop := lem.housekeepStop
+	lem.mu.Unlock()
+
+	// Align the first cycle to the next resolution-truncated boundary,
+	// exactly like a freshly started realManager would. Run the loop
+	// directly against a term-scoped stop channel rather than
+	// delegate.Housekeep, which would tear down the sink on every handoff.
+	go lem.delegate.housekeepUntil(housekeepStop)
+
+	<-stop
+
+	glog.Infof("lost leader lease %s/%s, no new housekeeping cycles will start", lem.config.ResourceNamespace, lem.config.ResourceName)
+	isLeader.Set(0)
+	leaderTransitionsTotal.WithLabelValues("lost").Inc()
+	lem.stopHousekeeping()
+}
+
+func (lem *LeaderElectedManager) onStoppedLeading() {
+	// Handled inline in onStartedLeading once <-stop unblocks; present to
+	// satisfy the leaderelection.LeaderCallbacks contract.
+}
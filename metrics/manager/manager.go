@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"time"
 
+	"k8s.io/heapster/metrics/alerting"
 	"k8s.io/heapster/metrics/core"
 
 	"github.com/golang/glog"
@@ -42,8 +43,15 @@ type realManager struct {
 	stopChan               chan struct{}
 	housekeepSemaphoreChan chan struct{}
 	housekeepTimeout       time.Duration
+	alertEvaluator         *alerting.Evaluator
 }
 
+// NewManager creates a manager that scrapes source on the given resolution,
+// runs data through processors, and hands the result off to sink. sink may
+// be a plain core.DataSink, a *core.FanoutSink, a *queue.Manager, or any
+// other wrapper; the housekeeping loop only ever calls ExportData on it, so
+// wrapping a sink in a queue.Manager (or fanning out to several via
+// core.FanoutSink) is enough to make ExportData non-blocking.
 func NewManager(source core.MetricsSource, processors []core.DataProcessor, sink core.DataSink, resolution time.Duration,
 	scrapeOffset time.Duration, maxParallelism int) (Manager, error) {
 	manager := realManager{
@@ -64,6 +72,13 @@ func NewManager(source core.MetricsSource, processors []core.DataProcessor, sink
 	return &manager, nil
 }
 
+// SetAlertEvaluator configures rm to evaluate evaluator's rules against
+// every batch produced by the processor pipeline, after processors run but
+// before the batch is exported to sink. Passing nil disables alerting.
+func (rm *realManager) SetAlertEvaluator(evaluator *alerting.Evaluator) {
+	rm.alertEvaluator = evaluator
+}
+
 func (rm *realManager) Start() {
 	go rm.Housekeep()
 }
@@ -73,6 +88,16 @@ func (rm *realManager) Stop() {
 }
 
 func (rm *realManager) Housekeep() {
+	rm.housekeepUntil(rm.stopChan)
+	rm.drainInFlight()
+	rm.sink.Stop()
+}
+
+// housekeepUntil runs the scrape loop until stop fires, without touching the
+// sink. LeaderElectedManager uses this directly (with a stop channel scoped
+// to a single leadership term) so that losing and regaining the lease only
+// pauses and resumes the loop instead of tearing down and rebuilding sink.
+func (rm *realManager) housekeepUntil(stop <-chan struct{}) {
 	for {
 		// Always try to get the newest metrics
 		now := time.Now()
@@ -83,13 +108,27 @@ func (rm *realManager) Housekeep() {
 		select {
 		case <-time.After(timeToNextSync):
 			rm.housekeep(start, end)
-		case <-rm.stopChan:
-			rm.sink.Stop()
+		case <-stop:
 			return
 		}
 	}
 }
 
+// drainInFlight blocks until every housekeep cycle already running has
+// released its housekeepSemaphoreChan slot, by reacquiring every slot and
+// handing them straight back. Callers use this after housekeepUntil returns
+// (so no new cycle can start) and before stopping the sink, so an in-flight
+// ExportData can never race a sink.Stop().
+func (rm *realManager) drainInFlight() {
+	slots := cap(rm.housekeepSemaphoreChan)
+	for i := 0; i < slots; i++ {
+		<-rm.housekeepSemaphoreChan
+	}
+	for i := 0; i < slots; i++ {
+		rm.housekeepSemaphoreChan <- struct{}{}
+	}
+}
+
 func (rm *realManager) housekeep(start, end time.Time) {
 	if !start.Before(end) {
 		glog.Warningf("Wrong time provided to housekeep start:%s end: %s", start, end)
@@ -120,6 +159,10 @@ func (rm *realManager) housekeep(start, end time.Time) {
 			}
 		}
 
+		if rm.alertEvaluator != nil {
+			rm.alertEvaluator.Evaluate(data)
+		}
+
 		//export time of the last metrics scrape to prometheus
 		timeStamp, err := time.Now().UTC().MarshalJSON()
 		if err != nil {
@@ -0,0 +1,579 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/heapster/metrics/core"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FsyncPolicy controls how aggressively the WAL flushes segment writes to
+// disk.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways fsyncs after every append.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval fsyncs on a fixed timer, batching appends in between.
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNone never fsyncs explicitly and relies on the OS to flush.
+	FsyncNone FsyncPolicy = "none"
+
+	segmentFilePrefix = "segment-"
+	checkpointFile    = "checkpoint"
+	defaultFsyncEvery = 5 * time.Second
+	// defaultSegmentRollInterval bounds how long a batch can sit in the
+	// active segment before it is rolled and becomes eligible for
+	// flushOnce, regardless of config.MaxSegmentSize. Without this, a
+	// healthy sink at modest volume would never fill a segment and export
+	// latency would be unbounded.
+	defaultSegmentRollInterval = 30 * time.Second
+)
+
+var (
+	walDir        = flag.String("wal-dir", "", "Directory for the on-disk write-ahead log buffering scrapes between processors and sinks. Disabled when empty.")
+	walMaxAge     = flag.Duration("wal-max-age", 24*time.Hour, "Maximum age of a checkpointed WAL segment before it is deleted.")
+	walMaxBytes   = flag.Int64("wal-max-bytes", 1<<30, "Maximum total size in bytes of checkpointed WAL segments before the oldest are deleted.")
+	walFsync      = flag.String("wal-fsync", string(FsyncInterval), "WAL fsync policy: always, interval, or none.")
+	walSegmentMax = flag.Int64("wal-segment-max-bytes", 64<<20, "Maximum size in bytes of a single WAL segment file before a new one is rolled.")
+)
+
+var (
+	walSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heapster_wal_size_bytes",
+		Help: "Total size in bytes of segments currently on disk in the WAL.",
+	})
+	walSegments = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heapster_wal_segments",
+		Help: "Number of segment files currently on disk in the WAL.",
+	})
+	walReplayDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heapster_wal_replay_duration_seconds",
+		Help: "Wall-clock time spent replaying un-checkpointed segments at startup.",
+	})
+	walFlushLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heapster_wal_flush_lag_seconds",
+		Help: "Time between a batch being appended to the WAL and its segment being acked by the sink.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(walSizeBytes)
+	prometheus.MustRegister(walSegments)
+	prometheus.MustRegister(walReplayDuration)
+	prometheus.MustRegister(walFlushLag)
+}
+
+// WALConfig configures a WAL.
+type WALConfig struct {
+	Dir            string
+	MaxAge         time.Duration
+	MaxBytes       int64
+	MaxSegmentSize int64
+	Fsync          FsyncPolicy
+}
+
+// WALConfigFromFlags builds a WALConfig from the --wal-* flags. Dir is empty
+// (and the WAL disabled) unless --wal-dir was passed.
+func WALConfigFromFlags() WALConfig {
+	return WALConfig{
+		Dir:            *walDir,
+		MaxAge:         *walMaxAge,
+		MaxBytes:       *walMaxBytes,
+		MaxSegmentSize: *walSegmentMax,
+		Fsync:          FsyncPolicy(*walFsync),
+	}
+}
+
+// segmentEntry is the gob-encoded, length-prefixed record written for each
+// housekeeping cycle's batch.
+type segmentEntry struct {
+	Batch *core.DataBatch
+}
+
+// WAL is an on-disk, segmented write-ahead log that sits between the
+// processor pipeline and sink.ExportData. Housekeep appends each cycle's
+// batch via ExportData, which returns as soon as the segment is written (and,
+// depending on config.Fsync, flushed); a separate flusher goroutine drains
+// segments to the wrapped sink and advances a persisted checkpoint so that
+// only un-acked segments are replayed on restart.
+type WAL struct {
+	config WALConfig
+	sink   core.DataSink
+
+	mu           sync.Mutex
+	activeFile   *os.File
+	activeWriter *bufio.Writer
+	activeSize   int64
+	activeSeq    int64
+
+	checkpointSeq int64
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewWAL opens (or creates) the WAL directory in config.Dir, replays any
+// un-checkpointed segments into sink synchronously, and starts the
+// background flusher. It wraps sink the same way a queue.Manager or
+// FanoutSink would: callers still just call ExportData/Stop.
+func NewWAL(config WALConfig, sink core.DataSink) (*WAL, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory %s: %v", config.Dir, err)
+	}
+
+	w := &WAL{
+		config:   config,
+		sink:     sink,
+		stopChan: make(chan struct{}),
+	}
+
+	checkpointSeq, err := w.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	w.checkpointSeq = checkpointSeq
+
+	replayStart := time.Now()
+	if err := w.replay(); err != nil {
+		return nil, err
+	}
+	walReplayDuration.Set(time.Now().Sub(replayStart).Seconds())
+
+	existing, err := w.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	w.activeSeq = w.checkpointSeq
+	for _, seq := range existing {
+		if seq > w.activeSeq {
+			w.activeSeq = seq
+		}
+	}
+
+	if err := w.rollSegment(); err != nil {
+		return nil, err
+	}
+
+	w.wg.Add(1)
+	go w.flushLoop()
+
+	w.updateSizeMetrics()
+
+	return w, nil
+}
+
+// Name identifies the wrapper for diagnostic purposes.
+func (w *WAL) Name() string {
+	return "wal:" + w.sink.Name()
+}
+
+// ExportData appends data as a new segment entry and returns once it has
+// durably hit disk according to config.Fsync; sink.ExportData is called
+// later, out of band, by the flusher.
+func (w *WAL) ExportData(data *core.DataBatch) {
+	if err := w.append(data); err != nil {
+		glog.Errorf("failed to append batch to WAL: %v", err)
+	}
+}
+
+// Stop stops the flusher and closes the active segment. It does not delete
+// any un-flushed segments; they will be replayed on the next startup.
+func (w *WAL) Stop() {
+	close(w.stopChan)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.activeWriter != nil {
+		w.activeWriter.Flush()
+	}
+	if w.activeFile != nil {
+		w.activeFile.Close()
+	}
+
+	w.sink.Stop()
+}
+
+func (w *WAL) segmentPath(seq int64) string {
+	return filepath.Join(w.config.Dir, fmt.Sprintf("%s%020d", segmentFilePrefix, seq))
+}
+
+func (w *WAL) rollSegment() error {
+	w.activeSeq++
+	f, err := os.OpenFile(w.segmentPath(w.activeSeq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.activeFile = f
+	w.activeWriter = bufio.NewWriter(f)
+	w.activeSize = 0
+	return nil
+}
+
+// append encodes data as a gob-encoded segmentEntry, writes it
+// length-prefixed to the active segment, and rolls to a new segment once the
+// active one exceeds config.MaxSegmentSize.
+func (w *WAL) append(data *core.DataBatch) error {
+	buf, err := encodeEntry(&segmentEntry{Batch: data})
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.activeSize > 0 && w.activeSize+int64(len(buf)) > w.config.MaxSegmentSize {
+		w.activeWriter.Flush()
+		w.activeFile.Close()
+		if err := w.rollSegment(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.activeWriter.Write(buf); err != nil {
+		return err
+	}
+	w.activeSize += int64(len(buf))
+
+	switch w.config.Fsync {
+	case FsyncAlways:
+		if err := w.activeWriter.Flush(); err != nil {
+			return err
+		}
+		return w.activeFile.Sync()
+	default:
+		return nil
+	}
+}
+
+func encodeEntry(entry *segmentEntry) ([]byte, error) {
+	var body bytes.Buffer
+	enc := gob.NewEncoder(&body)
+	if err := enc.Encode(entry); err != nil {
+		return nil, err
+	}
+
+	payload := body.Bytes()
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint64(header, uint64(len(payload)))
+	return append(header, payload...), nil
+}
+
+// flushLoop is the background flusher: it walks checkpointed-forward
+// segments in order, exports each to the wrapped sink, advances the
+// checkpoint, and reclaims old segments. It is decoupled from Housekeep so
+// export latency never affects scrape cadence.
+func (w *WAL) flushLoop() {
+	defer w.wg.Done()
+
+	fsyncTicker := time.NewTicker(defaultFsyncEvery)
+	defer fsyncTicker.Stop()
+
+	gcTicker := time.NewTicker(time.Minute)
+	defer gcTicker.Stop()
+
+	pollTicker := time.NewTicker(time.Second)
+	defer pollTicker.Stop()
+
+	rollTicker := time.NewTicker(defaultSegmentRollInterval)
+	defer rollTicker.Stop()
+
+	for {
+		select {
+		case <-pollTicker.C:
+			w.flushOnce()
+		case <-fsyncTicker.C:
+			if w.config.Fsync == FsyncInterval {
+				w.mu.Lock()
+				if w.activeWriter != nil {
+					w.activeWriter.Flush()
+					w.activeFile.Sync()
+				}
+				w.mu.Unlock()
+			}
+		case <-rollTicker.C:
+			w.rollIfNonEmpty()
+		case <-gcTicker.C:
+			w.garbageCollect()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// rollIfNonEmpty rolls the active segment if it has unflushed data, so that
+// flushOnce can pick it up on its next poll even if it never grew past
+// config.MaxSegmentSize.
+func (w *WAL) rollIfNonEmpty() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.activeSize == 0 {
+		return
+	}
+	w.activeWriter.Flush()
+	w.activeFile.Close()
+	if err := w.rollSegment(); err != nil {
+		glog.Errorf("failed to roll WAL segment: %v", err)
+	}
+}
+
+// flushOnce sends every fully-written segment newer than the checkpoint to
+// the sink, advancing the checkpoint after each successful export.
+func (w *WAL) flushOnce() {
+	segments, err := w.listSegments()
+	if err != nil {
+		glog.Errorf("failed to list WAL segments: %v", err)
+		return
+	}
+
+	w.mu.Lock()
+	activeSeq := w.activeSeq
+	w.mu.Unlock()
+
+	for _, seq := range segments {
+		if seq <= w.checkpointSeq || seq == activeSeq {
+			// Never flush the segment currently being appended to.
+			continue
+		}
+
+		entries, writtenAt, err := w.readSegment(seq)
+		if err != nil {
+			glog.Errorf("failed to read WAL segment %d: %v", seq, err)
+			return
+		}
+
+		for _, entry := range entries {
+			w.sink.ExportData(entry.Batch)
+		}
+		walFlushLag.Set(time.Now().Sub(writtenAt).Seconds())
+
+		if err := w.writeCheckpoint(seq); err != nil {
+			glog.Errorf("failed to advance WAL checkpoint to %d: %v", seq, err)
+			return
+		}
+		w.checkpointSeq = seq
+	}
+
+	w.updateSizeMetrics()
+}
+
+// replay exports every segment left over from a previous run that is newer
+// than the last checkpoint, before any new scrapes are accepted.
+func (w *WAL) replay() error {
+	segments, err := w.listSegments()
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range segments {
+		if seq <= w.checkpointSeq {
+			continue
+		}
+		entries, _, err := w.readSegment(seq)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			w.sink.ExportData(entry.Batch)
+		}
+		if err := w.writeCheckpoint(seq); err != nil {
+			return err
+		}
+		w.checkpointSeq = seq
+	}
+	return nil
+}
+
+// garbageCollect removes checkpointed segments older than config.MaxAge or
+// beyond config.MaxBytes, oldest first.
+func (w *WAL) garbageCollect() {
+	segments, err := w.listSegments()
+	if err != nil {
+		glog.Errorf("failed to list WAL segments during GC: %v", err)
+		return
+	}
+
+	var total int64
+	type segInfo struct {
+		seq     int64
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var infos []segInfo
+	for _, seq := range segments {
+		if seq > w.checkpointSeq {
+			continue
+		}
+		path := w.segmentPath(seq)
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, segInfo{seq: seq, path: path, size: fi.Size(), modTime: fi.ModTime()})
+		total += fi.Size()
+	}
+
+	now := time.Now()
+	for _, info := range infos {
+		if now.Sub(info.modTime) > w.config.MaxAge {
+			os.Remove(info.path)
+			total -= info.size
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].seq < infos[j].seq })
+	for _, info := range infos {
+		if total <= w.config.MaxBytes {
+			break
+		}
+		if err := os.Remove(info.path); err == nil {
+			total -= info.size
+		}
+	}
+}
+
+func (w *WAL) listSegments() ([]int64, error) {
+	files, err := os.ReadDir(w.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []int64
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), segmentFilePrefix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimPrefix(f.Name(), segmentFilePrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (w *WAL) readSegment(seq int64) ([]*segmentEntry, time.Time, error) {
+	path := w.segmentPath(seq)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	var entries []*segmentEntry
+	r := bufio.NewReader(f)
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				break
+			}
+			// A torn header means the process crashed mid-append; the
+			// segment's remaining bytes (if any) are unusable. Stop reading
+			// rather than failing the whole WAL.
+			if err == io.ErrUnexpectedEOF {
+				glog.Warningf("WAL segment %d has a torn trailing record header, truncating", seq)
+				break
+			}
+			return nil, time.Time{}, err
+		}
+		size := binary.BigEndian.Uint64(header)
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			// A torn payload has the same crash-mid-append cause; drop it.
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				glog.Warningf("WAL segment %d has a torn trailing record payload, truncating", seq)
+				break
+			}
+			return nil, time.Time{}, err
+		}
+
+		var entry segmentEntry
+		dec := gob.NewDecoder(bytes.NewReader(payload))
+		if err := dec.Decode(&entry); err != nil {
+			return nil, time.Time{}, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, fi.ModTime(), nil
+}
+
+func (w *WAL) readCheckpoint() (int64, error) {
+	path := filepath.Join(w.config.Dir, checkpointFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+	return seq, nil
+}
+
+func (w *WAL) writeCheckpoint(seq int64) error {
+	path := filepath.Join(w.config.Dir, checkpointFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(seq, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (w *WAL) updateSizeMetrics() {
+	segments, err := w.listSegments()
+	if err != nil {
+		return
+	}
+
+	var total int64
+	for _, seq := range segments {
+		if fi, err := os.Stat(w.segmentPath(seq)); err == nil {
+			total += fi.Size()
+		}
+	}
+	walSegments.Set(float64(len(segments)))
+	walSizeBytes.Set(float64(total))
+}
@@ -0,0 +1,492 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queue wraps a core.DataSink with a bounded, sharded queue so that
+// a slow or failing sink can no longer stall the scrape loop that calls
+// ExportData. Each shard runs its own sender goroutine and retries failed
+// batches with exponential backoff; a background controller grows or shrinks
+// the number of shards based on an EWMA of incoming vs. outgoing throughput,
+// similar in spirit to Prometheus's remote-write queue manager.
+package queue
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/heapster/metrics/core"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultMinShards is the smallest number of shards the controller will
+	// settle on, even under a completely idle sink.
+	DefaultMinShards = 1
+	// DefaultMaxShards bounds how many shards the controller may create.
+	DefaultMaxShards = 8
+	// DefaultShardCapacity is the number of batches buffered per shard
+	// before the oldest queued batch is dropped to make room for a new one.
+	DefaultShardCapacity = 32
+	// DefaultInitialBackoff is the delay before the first retry of a failed
+	// batch.
+	DefaultInitialBackoff = 1 * time.Second
+	// DefaultMaxBackoff caps the exponential backoff between retries.
+	DefaultMaxBackoff = 1 * time.Minute
+	// DefaultMaxRetries is how many times a batch is retried before it is
+	// given up on and counted as dropped.
+	DefaultMaxRetries = 5
+	// DefaultResizeInterval is how often the shard controller reevaluates
+	// the desired shard count.
+	DefaultResizeInterval = 30 * time.Second
+	// DefaultResizeCooldown is the minimum time between two shard count
+	// changes, to avoid flapping.
+	DefaultResizeCooldown = 2 * time.Minute
+	// ewmaAlpha weights the most recent sample in the rate EWMAs.
+	ewmaAlpha = 0.2
+	// scaleUpRatio: scale up when inRate exceeds outRate by this factor.
+	scaleUpRatio = 1.3
+	// scaleDownRatio: scale down when outRate exceeds inRate by this factor.
+	scaleDownRatio = 0.7
+)
+
+var (
+	samplesEnqueued = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "heapster_queue_manager_samples_enqueued_total",
+		Help: "Number of data points accepted onto the queue manager's shards.",
+	})
+	samplesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "heapster_queue_manager_samples_dropped_total",
+		Help: "Number of data points dropped because a shard's queue was full or retries were exhausted.",
+	})
+	samplesRetried = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "heapster_queue_manager_samples_retried_total",
+		Help: "Number of data points in batches whose export was retried after a failure.",
+	})
+	samplesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "heapster_queue_manager_samples_sent_total",
+		Help: "Number of data points successfully exported to the wrapped sink.",
+	})
+	shardCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heapster_queue_manager_shards",
+		Help: "Current number of shards the queue manager is running.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(samplesEnqueued)
+	prometheus.MustRegister(samplesDropped)
+	prometheus.MustRegister(samplesRetried)
+	prometheus.MustRegister(samplesSent)
+	prometheus.MustRegister(shardCount)
+}
+
+// Config controls the sharding, backpressure and autoscaling behavior of a
+// Manager.
+type Config struct {
+	MinShards      int
+	MaxShards      int
+	ShardCapacity  int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxRetries     int
+	ResizeInterval time.Duration
+	ResizeCooldown time.Duration
+}
+
+// DefaultConfig returns a Config populated with the package defaults.
+func DefaultConfig() Config {
+	return Config{
+		MinShards:      DefaultMinShards,
+		MaxShards:      DefaultMaxShards,
+		ShardCapacity:  DefaultShardCapacity,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+		MaxRetries:     DefaultMaxRetries,
+		ResizeInterval: DefaultResizeInterval,
+		ResizeCooldown: DefaultResizeCooldown,
+	}
+}
+
+// ewma is a simple exponentially weighted moving average, safe for
+// concurrent use.
+type ewma struct {
+	mu    sync.Mutex
+	value float64
+	set   bool
+}
+
+func (e *ewma) update(sample float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.set {
+		e.value = sample
+		e.set = true
+		return
+	}
+	e.value = ewmaAlpha*sample + (1-ewmaAlpha)*e.value
+}
+
+func (e *ewma) get() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value
+}
+
+// Manager wraps a core.DataSink with a bounded, sharded queue so that
+// ExportData never blocks the caller on a slow or failing sink.
+type Manager struct {
+	sink   core.DataSink
+	config Config
+
+	mu         sync.RWMutex
+	shards     []*shard
+	nextShard  uint64
+	lastResize time.Time
+
+	// totalEnqueued and totalSent are cumulative sample counts, updated
+	// atomically from ExportData and from each shard's sender goroutine.
+	// resizeLoop (the only reader) periodically diffs them against
+	// lastEnqueued/lastSent to derive an actual samples-per-second rate,
+	// rather than averaging individual batch sizes: in steady state every
+	// enqueued batch is eventually sent, so a per-batch-size average of in
+	// vs. out converges to the same value and never reflects backpressure.
+	totalEnqueued uint64
+	totalSent     uint64
+
+	lastSampleTime time.Time
+	lastEnqueued   uint64
+	lastSent       uint64
+
+	inRate  ewma
+	outRate ewma
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewManager creates a Manager that queues batches destined for sink across
+// config.MinShards shards, growing up to config.MaxShards under sustained
+// backpressure.
+func NewManager(sink core.DataSink, config Config) *Manager {
+	if config.MinShards <= 0 {
+		config.MinShards = DefaultMinShards
+	}
+	if config.MaxShards < config.MinShards {
+		config.MaxShards = config.MinShards
+	}
+	if config.ShardCapacity <= 0 {
+		config.ShardCapacity = DefaultShardCapacity
+	}
+	if config.ResizeInterval <= 0 {
+		config.ResizeInterval = DefaultResizeInterval
+	}
+	if config.ResizeCooldown <= 0 {
+		config.ResizeCooldown = DefaultResizeCooldown
+	}
+
+	m := &Manager{
+		sink:     sink,
+		config:   config,
+		stopChan: make(chan struct{}),
+	}
+
+	for i := 0; i < config.MinShards; i++ {
+		m.startShard()
+	}
+	shardCount.Set(float64(len(m.shards)))
+
+	m.wg.Add(1)
+	go m.resizeLoop()
+
+	return m
+}
+
+// Name identifies the wrapper for diagnostic purposes.
+func (m *Manager) Name() string {
+	return "queue_manager:" + m.sink.Name()
+}
+
+// ExportData enqueues data onto one of the manager's shards and returns
+// immediately; it never calls the wrapped sink synchronously.
+func (m *Manager) ExportData(data *core.DataBatch) {
+	atomic.AddUint64(&m.totalEnqueued, uint64(len(data.MetricSets)))
+
+	m.mu.RLock()
+	idx := atomic.AddUint64(&m.nextShard, 1) % uint64(len(m.shards))
+	s := m.shards[idx]
+	m.mu.RUnlock()
+
+	s.enqueue(data)
+}
+
+// Stop drains and stops every shard, then stops the wrapped sink.
+func (m *Manager) Stop() {
+	close(m.stopChan)
+	m.wg.Wait()
+
+	m.mu.Lock()
+	shards := m.shards
+	m.shards = nil
+	m.mu.Unlock()
+
+	for _, s := range shards {
+		s.stop()
+	}
+	m.sink.Stop()
+}
+
+func (m *Manager) startShard() *shard {
+	s := newShard(m.sink, m.config, &m.totalSent)
+	m.shards = append(m.shards, s)
+	return s
+}
+
+// resizeLoop periodically samples the in/out sample rates and recomputes the
+// desired shard count from the resulting EWMAs, growing or shrinking the
+// shard pool to match.
+func (m *Manager) resizeLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.config.ResizeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.sampleRates()
+			m.maybeResize()
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// sampleRates diffs the cumulative enqueued/sent counters against the last
+// sample to derive an actual samples-per-second rate and feeds it into the
+// in/out EWMAs. It is only ever called from resizeLoop, so the last* fields
+// need no locking.
+func (m *Manager) sampleRates() {
+	now := time.Now()
+	enqueued := atomic.LoadUint64(&m.totalEnqueued)
+	sent := atomic.LoadUint64(&m.totalSent)
+
+	if m.lastSampleTime.IsZero() {
+		m.lastSampleTime, m.lastEnqueued, m.lastSent = now, enqueued, sent
+		return
+	}
+
+	elapsed := now.Sub(m.lastSampleTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	m.inRate.update(float64(enqueued-m.lastEnqueued) / elapsed)
+	m.outRate.update(float64(sent-m.lastSent) / elapsed)
+
+	m.lastSampleTime, m.lastEnqueued, m.lastSent = now, enqueued, sent
+}
+
+func (m *Manager) maybeResize() {
+	m.mu.Lock()
+
+	if time.Since(m.lastResize) < m.config.ResizeCooldown {
+		m.mu.Unlock()
+		return
+	}
+
+	in := m.inRate.get()
+	out := m.outRate.get()
+	current := len(m.shards)
+	desired := current
+
+	switch {
+	case out == 0 && in > 0:
+		desired = current + 1
+	case in > out*scaleUpRatio:
+		desired = current + 1
+	case out > in*scaleDownRatio && current > m.config.MinShards:
+		desired = current - 1
+	}
+
+	if desired < m.config.MinShards {
+		desired = m.config.MinShards
+	}
+	if desired > m.config.MaxShards {
+		desired = m.config.MaxShards
+	}
+	if desired == current {
+		m.mu.Unlock()
+		return
+	}
+
+	glog.V(2).Infof("queue manager %s: resizing shards %d -> %d (inRate=%.2f outRate=%.2f)", m.Name(), current, desired, in, out)
+
+	var retired []*shard
+	if desired > current {
+		for i := current; i < desired; i++ {
+			m.startShard()
+		}
+	} else {
+		for i := current; i > desired; i-- {
+			last := m.shards[len(m.shards)-1]
+			m.shards = m.shards[:len(m.shards)-1]
+			retired = append(retired, last)
+		}
+	}
+
+	m.lastResize = time.Now()
+	shardCount.Set(float64(len(m.shards)))
+	m.mu.Unlock()
+
+	// Stop retired shards outside m.mu: stop() blocks until the shard's
+	// sender goroutine drains its queue, which may be asleep in a retry
+	// backoff (up to config.MaxBackoff) against a stuck sink. Holding the
+	// lock here would stall ExportData's RLock for that long, exactly the
+	// scrape-loop blocking this package exists to prevent.
+	for _, s := range retired {
+		s.stop()
+	}
+}
+
+// shard owns a single bounded queue and sender goroutine.
+type shard struct {
+	sink        core.DataSink
+	config      Config
+	sentCounter *uint64 // atomically added to on every successful export
+
+	queue    chan *core.DataBatch
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+func newShard(sink core.DataSink, config Config, sentCounter *uint64) *shard {
+	s := &shard{
+		sink:        sink,
+		config:      config,
+		sentCounter: sentCounter,
+		queue:       make(chan *core.DataBatch, config.ShardCapacity),
+		stopChan:    make(chan struct{}),
+		doneChan:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// enqueue adds data to the shard's queue, dropping the oldest queued batch
+// if the queue is already full.
+func (s *shard) enqueue(data *core.DataBatch) {
+	select {
+	case s.queue <- data:
+		samplesEnqueued.Add(float64(len(data.MetricSets)))
+	default:
+		select {
+		case oldest := <-s.queue:
+			samplesDropped.Add(float64(len(oldest.MetricSets)))
+		default:
+		}
+		select {
+		case s.queue <- data:
+			samplesEnqueued.Add(float64(len(data.MetricSets)))
+		default:
+			samplesDropped.Add(float64(len(data.MetricSets)))
+		}
+	}
+}
+
+func (s *shard) run() {
+	defer close(s.doneChan)
+	for {
+		select {
+		case data := <-s.queue:
+			s.sendWithRetry(data)
+		case <-s.stopChan:
+			// Drain whatever is left before exiting.
+			for {
+				select {
+				case data := <-s.queue:
+					s.sendWithRetry(data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *shard) sendWithRetry(data *core.DataBatch) {
+	backoff := s.config.InitialBackoff
+	if backoff <= 0 {
+		backoff = DefaultInitialBackoff
+	}
+	maxRetries := s.config.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = DefaultMaxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := s.export(data); err == nil {
+			samplesSent.Add(float64(len(data.MetricSets)))
+			atomic.AddUint64(s.sentCounter, uint64(len(data.MetricSets)))
+			return
+		} else if attempt >= maxRetries {
+			glog.Warningf("giving up on batch after %d retries: %v", attempt, err)
+			samplesDropped.Add(float64(len(data.MetricSets)))
+			return
+		} else {
+			samplesRetried.Add(float64(len(data.MetricSets)))
+			glog.V(3).Infof("export failed, retrying in %s: %v", backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > s.config.MaxBackoff && s.config.MaxBackoff > 0 {
+				backoff = s.config.MaxBackoff
+			}
+		}
+	}
+}
+
+// export calls through to the wrapped sink, recovering a panic into an
+// error so a single misbehaving sink cannot take down the shard goroutine.
+//
+// Note: core.DataSink.ExportData has no error return, so a panic is
+// currently the only failure export can observe; sendWithRetry's
+// retry/backoff path only ever triggers on that path. A sink that merely
+// logs and swallows its own errors is invisible here.
+func (s *shard) export(data *core.DataBatch) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errFromPanic(r)
+		}
+	}()
+	s.sink.ExportData(data)
+	return nil
+}
+
+func (s *shard) stop() {
+	close(s.stopChan)
+	<-s.doneChan
+}
+
+type panicError struct {
+	v interface{}
+}
+
+func (e panicError) Error() string {
+	return "panic in sink.ExportData"
+}
+
+func errFromPanic(v interface{}) error {
+	return panicError{v: v}
+}